@@ -11,7 +11,9 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"regexp"
 	"runtime"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -30,6 +32,28 @@ type LsInfo struct {
 	Files []FileStatusInfo `json:"files"`
 }
 
+type AvailabilityInfo struct {
+	Start     int64   `json:"start"`
+	End       int64   `json:"end"`
+	Available bool    `json:"available"`
+	Fraction  float64 `json:"fraction"`
+}
+
+type PieceDiagnostics struct {
+	Index        int      `json:"index"`
+	Have         bool     `json:"have"`
+	Priority     int      `json:"priority"`
+	Availability int      `json:"availability"`
+	Requested    bool     `json:"requested"`
+	Peers        []string `json:"peers"`
+}
+
+type StreamDiagnostics struct {
+	File         string             `json:"file"`
+	WaitingPiece int                `json:"waiting_piece"`
+	Pieces       []PieceDiagnostics `json:"pieces"`
+}
+
 type SessionStatus struct {
 	Name         string  `json:"name"`
 	State        int     `json:"state"`
@@ -43,18 +67,20 @@ type SessionStatus struct {
 }
 
 type Config struct {
-	uri             string
-	bindAddress     string
-	maxUploadRate   int
-	maxDownloadRate int
-	downloadPath    string
-	keepFiles       bool
-	encryption      int
-	noSparseFile    bool
-	idleTimeout     int
-	portLower       int
-	portUpper       int
-	buffer          float64
+	uri                 string
+	bindAddress         string
+	maxUploadRate       int
+	maxDownloadRate     int
+	downloadPath        string
+	keepFiles           bool
+	encryption          int
+	noSparseFile        bool
+	idleTimeout         int
+	portLower           int
+	portUpper           int
+	buffer              float64
+	completeAfterStream bool
+	duplicatePaths      string
 }
 
 type Instance struct {
@@ -139,6 +165,171 @@ func lsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(output)
 }
 
+func endpointAddress(endpoint libtorrent.Tcp_endpoint) string {
+	address := endpoint.Address()
+	defer libtorrent.DeleteAddress(address)
+	return address.To_string()
+}
+
+func streamDiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	diagnostics := StreamDiagnostics{
+		WaitingPiece: instance.torrentFS.WaitingPiece(),
+		Pieces:       []PieceDiagnostics{},
+	}
+	if file, firstPiece := instance.torrentFS.StreamedFile(); file != nil {
+		diagnostics.File = file.Name()
+
+		// Readahead window: from the current read position, buffer percentage of the file
+		startPiece, endPiece := file.Pieces()
+		lastPiece := firstPiece + int(math.Ceil(instance.config.buffer*float64(endPiece-startPiece)))
+		if lastPiece > endPiece {
+			lastPiece = endPiece
+		}
+		// Always cover the piece a Read of this file is blocked on
+		if waiting := diagnostics.WaitingPiece; waiting >= startPiece && waiting <= endPiece {
+			if waiting < firstPiece {
+				firstPiece = waiting
+			}
+			if waiting > lastPiece {
+				lastPiece = waiting
+			}
+		}
+
+		availability := libtorrent.NewStd_vector_int()
+		defer libtorrent.DeleteStd_vector_int(availability)
+		instance.torrentHandle.Piece_availability(availability)
+
+		// Peers with blocks of a piece outstanding, from the download queue, plus
+		// peers currently receiving a block of it
+		requested := make(map[int]bool)
+		servingPeers := make(map[int][]string)
+		addPeer := func(piece int, address string) {
+			for _, p := range servingPeers[piece] {
+				if p == address {
+					return
+				}
+			}
+			servingPeers[piece] = append(servingPeers[piece], address)
+		}
+
+		queue := libtorrent.NewStd_vector_partial_piece_info()
+		defer libtorrent.DeleteStd_vector_partial_piece_info(queue)
+		instance.torrentHandle.Get_download_queue(queue)
+		for i := 0; i < int(queue.Size()); i++ {
+			info := queue.Get(i)
+			piece := info.GetPiece_index()
+			requested[piece] = info.GetRequested() > 0
+			blocks := info.GetBlocks()
+			for j := 0; j < info.GetBlocks_in_piece(); j++ {
+				block := libtorrent.Block_info_array_getitem(blocks, j)
+				if block.GetState() != libtorrent.Block_infoNone {
+					endpoint := block.Peer()
+					addPeer(piece, endpointAddress(endpoint))
+					libtorrent.DeleteTcp_endpoint(endpoint)
+				}
+				libtorrent.DeleteBlock_info(block)
+			}
+		}
+
+		peers := libtorrent.NewStd_vector_peer_info()
+		defer libtorrent.DeleteStd_vector_peer_info(peers)
+		instance.torrentHandle.Get_peer_info(peers)
+		for i := 0; i < int(peers.Size()); i++ {
+			peer := peers.Get(i)
+			if piece := peer.GetDownloading_piece_index(); piece >= 0 {
+				addPeer(piece, endpointAddress(peer.GetIp()))
+			}
+		}
+
+		for piece := firstPiece; piece <= lastPiece; piece++ {
+			pd := PieceDiagnostics{
+				Index:     piece,
+				Have:      instance.torrentHandle.Have_piece(piece),
+				Priority:  instance.torrentHandle.Piece_priority(piece).(int),
+				Requested: requested[piece],
+				Peers:     servingPeers[piece],
+			}
+			if piece < int(availability.Size()) {
+				pd.Availability = availability.Get(piece)
+			}
+			if pd.Peers == nil {
+				pd.Peers = []string{}
+			}
+			diagnostics.Pieces = append(diagnostics.Pieces, pd)
+		}
+	}
+
+	output, _ := json.Marshal(diagnostics)
+	w.Write(output)
+}
+
+var availablePath = regexp.MustCompile(`^(\d+)/available$`)
+
+func availableHandler(w http.ResponseWriter, r *http.Request, index int) {
+	if instance.torrentFS.ti == nil {
+		http.Error(w, "Metadata not available yet", http.StatusServiceUnavailable)
+		return
+	}
+	file, err := instance.torrentFS.FileAt(index)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	start, end := int64(0), file.Size()-1
+	if file.Size() == 0 {
+		end = 0
+	}
+	if v := r.URL.Query().Get("start"); v != "" {
+		if start, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid start", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("end"); v != "" {
+		if end, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid end", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var info AvailabilityInfo
+	if file.Size() == 0 && start == 0 && end == 0 {
+		// Nothing to download for an empty file
+		info = AvailabilityInfo{Start: 0, End: 0, Available: true, Fraction: 1}
+	} else if start < 0 || end < start || end >= file.Size() {
+		http.Error(w, "Invalid range", http.StatusBadRequest)
+		return
+	} else {
+		have, total := file.PiecesAvailable(start, end)
+		info = AvailabilityInfo{
+			Start:     start,
+			End:       end,
+			Available: have == total,
+			Fraction:  float64(have) / float64(total),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	output, _ := json.Marshal(info)
+	w.Write(output)
+}
+
+// Serves /files/<index>/available, unless a torrent file has that very path,
+// and falls back to the torrent file server for everything else.
+func filesHandler(fileServer http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if match := availablePath.FindStringSubmatch(r.URL.Path); match != nil && instance.torrentFS.HasFile(r.URL.Path) == false {
+			index, _ := strconv.Atoi(match[1])
+			availableHandler(w, r, index)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
 func startServices() {
 	log.Println("Starting DHT...")
 	instance.session.Start_dht()
@@ -219,12 +410,18 @@ func parseFlags() {
 	flag.IntVar(&config.portLower, "port-lower", 6900, "Lower bound for listen port.")
 	flag.IntVar(&config.portUpper, "port-upper", 6999, "Upper bound for listen port.")
 	flag.Float64Var(&config.buffer, "buffer", 0.01, "Buffer percentage from start of file.")
+	flag.StringVar(&config.duplicatePaths, "duplicate-paths", "rename", "Duplicate file paths in torrent: rename (add a suffix) or refuse (shutdown)")
+	flag.BoolVar(&config.completeAfterStream, "complete-after-stream", false, "Download the whole torrent once the streamed file is complete.")
 	flag.Parse()
 
 	if config.uri == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if config.duplicatePaths != "rename" && config.duplicatePaths != "refuse" {
+		flag.Usage()
+		os.Exit(1)
+	}
 
 	instance.config = config
 }
@@ -293,7 +490,8 @@ func startHTTP() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/status", statusHandler)
 	mux.HandleFunc("/ls", lsHandler)
-	mux.Handle("/files/", http.StripPrefix("/files/", http.FileServer(instance.torrentFS)))
+	mux.HandleFunc("/stream-diagnostics", streamDiagnosticsHandler)
+	mux.Handle("/files/", http.StripPrefix("/files/", filesHandler(http.FileServer(instance.torrentFS))))
 	mux.Handle("/shutdown", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		go shutdown()
 		fmt.Fprintf(w, "OK")
@@ -345,6 +543,46 @@ func ensureSeeding() {
 	}
 }
 
+// Renames files with duplicate paths, unless -duplicate-paths=refuse, in which
+// case it returns false.
+func resolveDuplicatePaths(ti libtorrent.Torrent_info, rename func(int, string)) bool {
+	renames := DuplicatePaths(ti)
+	for i, newPath := range renames {
+		log.Printf("Warning: file %d has duplicate path %s\n", i, ti.File_at(i).GetPath())
+		if instance.config.duplicatePaths == "rename" {
+			log.Printf("Renaming file %d to %s\n", i, newPath)
+			rename(i, newPath)
+		}
+	}
+	return len(renames) == 0 || instance.config.duplicatePaths == "rename"
+}
+
+// Torrents fetched from a link are added in upload mode, so nothing is written
+// to disk until their paths have been checked.
+func handleDuplicatePaths() {
+	instance.torrentFS.ensureTorrentInfo()
+	if resolveDuplicatePaths(instance.torrentFS.ti, instance.torrentHandle.Rename_file) == false {
+		log.Println("Refusing torrent with duplicate file paths")
+		go shutdown()
+		return
+	}
+	log.Println("Leaving upload mode")
+	instance.torrentHandle.Set_upload_mode(false)
+}
+
+// Files are held back by TorrentFS until streamed, see NewTorrentFS.
+func completeAfterStream() {
+	log.Println("Starting complete-after-stream watcher")
+	for {
+		if tf, _ := instance.torrentFS.StreamedFile(); tf != nil && tf.IsComplete() {
+			break
+		}
+		time.Sleep(1 * time.Second)
+	}
+	log.Println("Streamed file is complete, downloading remaining files")
+	instance.torrentFS.ReleaseFiles()
+}
+
 func main() {
 	// Make sure we are properly multithreaded, on a minimum of 2 threads
 	// because we lock the main thread for libtorrent.
@@ -361,10 +599,14 @@ func main() {
 	if fileUri.Scheme == "file" {
 		log.Printf("Opening local file %s\n", fileUri.Path)
 		torrentInfo := libtorrent.NewTorrent_info(fileUri.Path)
+		if resolveDuplicatePaths(torrentInfo, torrentInfo.Rename_file) == false {
+			log.Fatal("Refusing torrent with duplicate file paths")
+		}
 		torrentParams.SetTi(torrentInfo)
 	} else {
 		log.Println("Fetching link")
 		torrentParams.SetUrl(instance.config.uri)
+		torrentParams.SetFlags(torrentParams.GetFlags() | libtorrent.Add_torrent_paramsFlag_upload_mode)
 	}
 
 	log.Println("Setting save path")
@@ -384,13 +626,18 @@ func main() {
 
 	log.Println("Adding torrent")
 	instance.torrentHandle = instance.session.Add_torrent(torrentParams)
+	if fileUri.Scheme != "file" {
+		// The flag is ignored when add_torrent_params carries flag_ignore_flags
+		log.Println("Entering upload mode until paths are checked")
+		instance.torrentHandle.Set_upload_mode(true)
+	}
 
 	log.Println("Enabling sequential download")
 	instance.torrentHandle.Set_sequential_download(true)
 
 	log.Printf("Downloading: %s\n", instance.torrentHandle.Name())
 
-	instance.torrentFS = NewTorrentFS(instance.torrentHandle)
+	instance.torrentFS = NewTorrentFS(instance.torrentHandle, instance.config.completeAfterStream)
 
 	// go func() {
 	// 	for {
@@ -399,6 +646,13 @@ func main() {
 	// 	}
 	// }()
 
+	if fileUri.Scheme != "file" {
+		go handleDuplicatePaths()
+	}
+	if instance.config.completeAfterStream {
+		go completeAfterStream()
+	}
+
 	go handleSignals()
 	go watchParent()
 
@@ -8,6 +8,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/steeve/libtorrent-go"
@@ -18,8 +19,13 @@ const (
 )
 
 type TorrentFS struct {
-	th libtorrent.Torrent_handle
-	ti libtorrent.Torrent_info
+	th           libtorrent.Torrent_handle
+	ti           libtorrent.Torrent_info
+	streamLock   sync.Mutex
+	holdFiles    bool         // files download only once streamed, until ReleaseFiles
+	streamedFile *TorrentFile // last torrent file read from or seeked into
+	streamPiece  int          // piece at its current read position
+	waitingPiece int          // piece a Read is blocked on, or -1
 }
 
 type TorrentFile struct {
@@ -32,23 +38,128 @@ type TorrentFile struct {
 	virtualRead bool
 }
 
-func NewTorrentFS(th libtorrent.Torrent_handle) *TorrentFS {
-	tfs := TorrentFS{th: th}
+func NewTorrentFS(th libtorrent.Torrent_handle, holdFiles bool) *TorrentFS {
+	tfs := TorrentFS{th: th, holdFiles: holdFiles, waitingPiece: -1}
 	go func() {
 		for tfs.th.Status().GetHas_metadata() == false {
 			time.Sleep(100 * time.Millisecond)
 		}
-		tfs.ti = tfs.th.Get_torrent_info()
+		ti := tfs.th.Get_torrent_info()
+		// Hold files before any can be opened, so no stream priorities get reset
+		if holdFiles {
+			log.Println("Holding files until streamed")
+			tfs.prioritizeFiles(ti.Num_files(), 0)
+		}
+		tfs.ti = ti
 	}()
 	return &tfs
 }
 
+func (tfs *TorrentFS) prioritizeFiles(numFiles int, priority int) {
+	priorities := libtorrent.NewStd_vector_int()
+	defer libtorrent.DeleteStd_vector_int(priorities)
+	for i := 0; i < numFiles; i++ {
+		priorities.Add(priority)
+	}
+	tfs.th.Prioritize_files(priorities)
+}
+
+// Lets every file download, if they were held back.
+func (tfs *TorrentFS) ReleaseFiles() {
+	tfs.streamLock.Lock()
+	defer tfs.streamLock.Unlock()
+	if tfs.holdFiles {
+		tfs.holdFiles = false
+		tfs.prioritizeFiles(tfs.ti.Num_files(), 1)
+	}
+}
+
+// Lets a held file download, as it is about to be streamed.
+func (tfs *TorrentFS) releaseFile(index int) {
+	tfs.streamLock.Lock()
+	defer tfs.streamLock.Unlock()
+	if tfs.holdFiles && tfs.th.File_priority(index).(int) == 0 {
+		log.Printf("Releasing file %d\n", index)
+		tfs.th.File_priority(index, 1)
+	}
+}
+
+func (tfs *TorrentFS) setStreamedFile(tf *TorrentFile, piece int) {
+	tfs.streamLock.Lock()
+	defer tfs.streamLock.Unlock()
+	if tfs.streamedFile == nil || tfs.streamedFile.fe_idx != tf.fe_idx {
+		log.Printf("Streaming file %s\n", tf.Name())
+	}
+	tfs.streamedFile = tf
+	tfs.streamPiece = piece
+}
+
+func (tfs *TorrentFS) setWaitingPiece(piece int) {
+	tfs.streamLock.Lock()
+	defer tfs.streamLock.Unlock()
+	tfs.waitingPiece = piece
+}
+
+func (tfs *TorrentFS) WaitingPiece() int {
+	tfs.streamLock.Lock()
+	defer tfs.streamLock.Unlock()
+	return tfs.waitingPiece
+}
+
+func (tfs *TorrentFS) StreamedFile() (*TorrentFile, int) {
+	tfs.streamLock.Lock()
+	defer tfs.streamLock.Unlock()
+	return tfs.streamedFile, tfs.streamPiece
+}
+
 func (tfs *TorrentFS) ensureTorrentInfo() {
 	for tfs.ti == nil {
 		time.Sleep(100 * time.Millisecond)
 	}
 }
 
+// Finds files sharing a path with an earlier file of the torrent, and returns
+// a unique replacement path for each of them, keyed by file index.
+func DuplicatePaths(ti libtorrent.Torrent_info) map[int]string {
+	paths := make([]string, ti.Num_files())
+	for i := range paths {
+		paths[i] = ti.File_at(i).GetPath()
+	}
+	return uniquePaths(paths)
+}
+
+// Paths are compared case insensitively, since they collide on Windows,
+// OS X and FAT filesystems.
+func uniquePaths(paths []string) map[int]string {
+	pathKey := func(p string) string {
+		return strings.ToLower(path.Clean(p))
+	}
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		seen[pathKey(p)] = true
+	}
+	used := make(map[string]bool)
+	renames := make(map[int]string)
+	for i, p := range paths {
+		p = path.Clean(p)
+		if used[pathKey(p)] == false {
+			used[pathKey(p)] = true
+			continue
+		}
+		ext := path.Ext(p)
+		base := strings.TrimSuffix(p, ext)
+		for n := 1; ; n++ {
+			newPath := fmt.Sprintf("%s.%d%s", base, n, ext)
+			if seen[pathKey(newPath)] == false && used[pathKey(newPath)] == false {
+				used[pathKey(newPath)] = true
+				renames[i] = newPath
+				break
+			}
+		}
+	}
+	return renames
+}
+
 func (tfs *TorrentFS) TFSOpen(name string) (*TorrentFile, error) {
 	log.Printf("Opening %s\n", name)
 	tfs.ensureTorrentInfo()
@@ -69,6 +180,27 @@ func (tfs *TorrentFS) Open(name string) (http.File, error) {
 	return tfs.TFSOpen(name)
 }
 
+// Tells whether the torrent has a file at the given relative path, without
+// waiting for metadata.
+func (tfs *TorrentFS) HasFile(name string) bool {
+	if tfs.ti == nil {
+		return false
+	}
+	for i := 0; i < tfs.ti.Num_files(); i++ {
+		if path.Clean(tfs.ti.File_at(i).GetPath()) == path.Clean(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tfs *TorrentFS) FileAt(index int) (*TorrentFile, error) {
+	if index < 0 || index >= tfs.ti.Num_files() {
+		return nil, os.ErrNotExist
+	}
+	return &TorrentFile{tfs: tfs, fe: tfs.ti.File_at(index), fe_idx: index}, nil
+}
+
 func NewTorrentFile(tfs *TorrentFS, name string) (tf *TorrentFile, err error) {
 	tf = &TorrentFile{tfs: tfs}
 
@@ -145,12 +277,18 @@ func (tf *TorrentFile) pieceFromOffset(offset int64) (int, int) {
 
 func (tf *TorrentFile) waitForPiece(piece int) {
 	log.Printf("Waiting for piece %d\n", piece)
+	tf.tfs.setWaitingPiece(piece)
+	defer tf.tfs.setWaitingPiece(-1)
 	for tf.tfs.th.Piece_priority(piece).(int) > 0 && tf.tfs.th.Have_piece(piece) == false {
 		time.Sleep(100 * time.Millisecond)
 	}
 }
 
 func (tf *TorrentFile) Read(data []byte) (int, error) {
+	// A held file is never written to disk, release it before waiting on it
+	if tf.fe != nil {
+		tf.tfs.releaseFile(tf.fe_idx)
+	}
 	tf.ensureFp()
 
 	// Dirty hack to ensure we don't need the last VIRTUAL_READ_MAX_END_OFFSET of a file to read it.
@@ -161,6 +299,10 @@ func (tf *TorrentFile) Read(data []byte) (int, error) {
 	}
 
 	currentOffset, _ := tf.fp.Seek(0, os.SEEK_CUR)
+	if tf.fe != nil {
+		piece, _ := tf.pieceFromOffset(currentOffset)
+		tf.tfs.setStreamedFile(tf, piece)
+	}
 
 	if len(data) <= tf.tfs.ti.Piece_length() {
 		piece, _ := tf.pieceFromOffset(currentOffset + int64(len(data)))
@@ -179,6 +321,9 @@ func (tf *TorrentFile) Read(data []byte) (int, error) {
 }
 
 func (tf *TorrentFile) Seek(offset int64, whence int) (int64, error) {
+	if tf.fe != nil {
+		tf.tfs.releaseFile(tf.fe_idx)
+	}
 	tf.ensureFp()
 
 	// We are trying to read at the end of the file and we don't have the piece? Virtual read!
@@ -193,6 +338,9 @@ func (tf *TorrentFile) Seek(offset int64, whence int) (int64, error) {
 
 	piece, _ := tf.pieceFromOffset(offset)
 	startPiece, endPiece := tf.Pieces()
+	if tf.fe != nil {
+		tf.tfs.setStreamedFile(tf, piece)
+	}
 	for i := startPiece; i <= endPiece; i++ {
 		if i < piece {
 			tf.tfs.th.Piece_priority(i, 0)
@@ -263,6 +411,31 @@ func (tf *TorrentFile) CompletedPieces() int {
 	return endPiece - startPiece
 }
 
+// Pieces set to priority 0, like those skipped by a Seek, are not required.
+func (tf *TorrentFile) IsComplete() bool {
+	startPiece, endPiece := tf.Pieces()
+	for i := startPiece; i <= endPiece; i++ {
+		if tf.tfs.th.Have_piece(i) == false && tf.tfs.th.Piece_priority(i).(int) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Counts the downloaded pieces covering the [start, end] byte range of the file,
+// without waiting for them or touching their priorities.
+func (tf *TorrentFile) PiecesAvailable(start int64, end int64) (int, int) {
+	startPiece, _ := tf.pieceFromOffset(start)
+	endPiece, _ := tf.pieceFromOffset(end)
+	have := 0
+	for i := startPiece; i <= endPiece; i++ {
+		if tf.tfs.th.Have_piece(i) {
+			have++
+		}
+	}
+	return have, endPiece - startPiece + 1
+}
+
 func (tf *TorrentFile) SetPriority(priority int) {
 	log.Print("Setting priority %d to file %s\n", priority, tf.Name())
 	tf.tfs.th.File_priority(tf.fe_idx, priority)
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/steeve/libtorrent-go"
+)
+
+func TestUniquePaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		paths   []string
+		renames map[int]string
+	}{
+		{
+			name:    "no duplicates",
+			paths:   []string{"a/b.mkv", "a/c.mkv"},
+			renames: map[int]string{},
+		},
+		{
+			name:    "identical paths",
+			paths:   []string{"a/b.mkv", "a/b.mkv", "a/b.mkv"},
+			renames: map[int]string{1: "a/b.1.mkv", 2: "a/b.2.mkv"},
+		},
+		{
+			name:    "identical after clean",
+			paths:   []string{"a/b.mkv", "a/./b.mkv", "a//b.mkv"},
+			renames: map[int]string{1: "a/b.1.mkv", 2: "a/b.2.mkv"},
+		},
+		{
+			name:    "differing case",
+			paths:   []string{"a/b.mkv", "A/B.MKV"},
+			renames: map[int]string{1: "A/B.1.MKV"},
+		},
+		{
+			name:    "suffix taken by existing file",
+			paths:   []string{"a/x.mkv", "a/x.mkv", "a/x.1.mkv"},
+			renames: map[int]string{1: "a/x.2.mkv"},
+		},
+		{
+			name:    "no extension",
+			paths:   []string{"a/README", "a/README", "a/README.1"},
+			renames: map[int]string{1: "a/README.2"},
+		},
+	}
+
+	for _, test := range tests {
+		renames := uniquePaths(test.paths)
+		if !reflect.DeepEqual(renames, test.renames) {
+			t.Errorf("%s: got %v, want %v", test.name, renames, test.renames)
+		}
+	}
+}
+
+func TestDuplicatePaths(t *testing.T) {
+	ti := libtorrent.NewTorrent_info("testdata/duplicate_paths.torrent")
+	renames := DuplicatePaths(ti)
+	want := map[int]string{
+		1: "dup/movie.1.mkv",
+		2: "dup/Movie.2.MKV",
+		4: "dup/extras/readme.1",
+	}
+	if !reflect.DeepEqual(renames, want) {
+		t.Errorf("got %v, want %v", renames, want)
+	}
+}